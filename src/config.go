@@ -7,8 +7,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"sync/atomic"
-	"time"
 )
 
 type IPCError struct {
@@ -23,53 +21,45 @@ func (s *IPCError) ErrorCode() int64 {
 	return s.Code
 }
 
+// ipcGetOperation marshals a DeviceState (see configdevice.go) as the
+// line-based text UAPI.
 func ipcGetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
-	// create lines
-
-	device.mutex.RLock()
+	state := device.Snapshot()
 
 	lines := make([]string, 0, 100)
 	send := func(line string) {
 		lines = append(lines, line)
 	}
 
-	if !device.privateKey.IsZero() {
-		send("private_key=" + device.privateKey.ToHex())
+	if !state.PrivateKey.IsZero() {
+		send("private_key=" + state.PrivateKey.ToHex())
 	}
 
-	send(fmt.Sprintf("listen_port=%d", device.net.addr.Port))
-
-	for _, peer := range device.peers {
-		func() {
-			peer.mutex.RLock()
-			defer peer.mutex.RUnlock()
-			send("public_key=" + peer.handshake.remoteStatic.ToHex())
-			send("preshared_key=" + peer.handshake.presharedKey.ToHex())
-			if peer.endpoint != nil {
-				send("endpoint=" + peer.endpoint.String())
-			}
-
-			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+	send(fmt.Sprintf("listen_port=%d", state.ListenPort))
+	send("transport=" + state.Transport)
 
-			send(fmt.Sprintf("last_handshake_time_sec=%d", secs))
-			send(fmt.Sprintf("last_handshake_time_nsec=%d", nano))
-			send(fmt.Sprintf("tx_bytes=%d", peer.stats.txBytes))
-			send(fmt.Sprintf("rx_bytes=%d", peer.stats.rxBytes))
-			send(fmt.Sprintf("persistent_keepalive_interval=%d",
-				atomic.LoadUint64(&peer.persistentKeepaliveInterval),
-			))
+	for _, peer := range state.Peers {
+		send("public_key=" + peer.PublicKey.ToHex())
+		send("preshared_key=" + peer.PresharedKey.ToHex())
+		if peer.Endpoint != nil {
+			send("endpoint=" + peer.Endpoint.String())
+		}
 
-			for _, ip := range device.routingTable.AllowedIPs(peer) {
-				send("allowed_ip=" + ip.String())
-			}
-		}()
+		send(fmt.Sprintf("last_handshake_time_sec=%d", peer.LastHandshakeTimeSec))
+		send(fmt.Sprintf("last_handshake_time_nsec=%d", peer.LastHandshakeTimeNsec))
+		send(fmt.Sprintf("tx_bytes=%d", peer.TxBytes))
+		send(fmt.Sprintf("rx_bytes=%d", peer.RxBytes))
+		send(fmt.Sprintf("persistent_keepalive_interval=%d", peer.PersistentKeepaliveInterval))
+		send(fmt.Sprintf("rx_dropped=%d", peer.RxDropped))
+		send(fmt.Sprintf("rx_queue_depth=%d", peer.RxQueueDepth))
+		send(fmt.Sprintf("tx_queue_depth=%d", peer.TxQueueDepth))
+
+		for _, ip := range peer.AllowedIPs {
+			send("allowed_ip=" + ip.String())
+		}
 	}
 
-	device.mutex.RUnlock()
-
 	// send lines
 
 	for _, line := range lines {
@@ -84,12 +74,14 @@ func ipcGetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 	return nil
 }
 
+// ipcSetOperation decodes the line-based text UAPI into a DeviceConfig
+// (see configdevice.go) and applies it via device.Configure.
 func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 	scanner := bufio.NewScanner(socket)
 	logError := device.log.Error
-	logDebug := device.log.Debug
 
-	var peer *Peer
+	cfg := &DeviceConfig{}
+	var peerCfg *PeerConfig
 
 	deviceConfig := true
 
@@ -99,7 +91,7 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 
 		line := scanner.Text()
 		if line == "" {
-			return nil
+			break
 		}
 		parts := strings.Split(line, "=")
 		if len(parts) != 2 {
@@ -115,16 +107,13 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 			switch key {
 			case "private_key":
 				var sk NoisePrivateKey
-				if value == "" {
-					device.SetPrivateKey(sk)
-				} else {
-					err := sk.FromHex(value)
-					if err != nil {
+				if value != "" {
+					if err := sk.FromHex(value); err != nil {
 						logError.Println("Failed to set private_key:", err)
 						return &IPCError{Code: ipcErrorInvalid}
 					}
-					device.SetPrivateKey(sk)
 				}
+				cfg.PrivateKey = &sk
 
 			case "listen_port":
 				port, err := strconv.ParseUint(value, 10, 16)
@@ -132,25 +121,24 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to set listen_port:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				netc := &device.net
-				netc.mutex.Lock()
-				if netc.addr.Port != int(port) {
-					if netc.conn != nil {
-						netc.conn.Close()
-					}
-					netc.addr.Port = int(port)
-					netc.conn, err = net.ListenUDP("udp", netc.addr)
-				}
-				netc.mutex.Unlock()
+				p := uint16(port)
+				cfg.ListenPort = &p
+
+			case "fwmark":
+				mark, err := strconv.ParseUint(value, 10, 32)
 				if err != nil {
-					logError.Println("Failed to create UDP listener:", err)
-					return &IPCError{Code: ipcErrorIO}
+					logError.Println("Failed to set fwmark:", err)
+					return &IPCError{Code: ipcErrorInvalid}
 				}
-				// TODO: Clear source address of all peers
+				m := uint32(mark)
+				cfg.FwMark = &m
 
-			case "fwmark":
-				logError.Println("FWMark not handled yet")
-				// TODO: Clear source address of all peers
+			case "transport":
+				if value != "udp" && value != "tcp" {
+					logError.Println("Failed to set transport, invalid value:", value)
+					return &IPCError{Code: ipcErrorInvalid}
+				}
+				cfg.Transport = &value
 
 			case "public_key":
 
@@ -163,7 +151,7 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to set replace_peers, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				device.RemoveAllPeers()
+				cfg.ReplacePeers = true
 
 			default:
 				logError.Println("Invalid UAPI key (device configuration):", key)
@@ -184,54 +172,68 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to get peer by public_key:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-
-				// check if public key of peer equal to device
-
-				device.mutex.RLock()
-				if device.publicKey.Equals(pubKey) {
-					device.mutex.RUnlock()
-					logError.Println("Public key of peer matches private key of device")
-					return &IPCError{Code: ipcErrorInvalid}
-				}
-
-				// find peer referenced
-
-				peer, _ = device.peers[pubKey]
-				device.mutex.RUnlock()
-				if peer == nil {
-					peer = device.NewPeer(pubKey)
-				}
+				cfg.Peers = append(cfg.Peers, PeerConfig{PublicKey: pubKey})
+				peerCfg = &cfg.Peers[len(cfg.Peers)-1]
 
 			case "remove":
 				if value != "true" {
 					logError.Println("Failed to set remove, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				device.RemovePeer(peer.handshake.remoteStatic)
-				logDebug.Println("Removing", peer.String())
-				peer = nil
+				peerCfg.Remove = true
 
 			case "preshared_key":
-				err := func() error {
-					peer.mutex.Lock()
-					defer peer.mutex.Unlock()
-					return peer.handshake.presharedKey.FromHex(value)
-				}()
-				if err != nil {
+				var psk NoisePresharedKey
+				if err := psk.FromHex(value); err != nil {
 					logError.Println("Failed to set preshared_key:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
+				peerCfg.PresharedKey = &psk
 
 			case "endpoint":
 				// TODO: Only IP and port
+
+				// The text UAPI always names endpoints as host:port; which
+				// Endpoint type that becomes depends on the transport this
+				// device is (or is about to be, if "transport" appears
+				// earlier in the same set=1 request) configured for.
+				transportKind := cfg.Transport
+				if transportKind == nil {
+					device.net.mutex.RLock()
+					kind := device.net.transportKind
+					device.net.mutex.RUnlock()
+					transportKind = &kind
+				}
+
+				if *transportKind == "tcp" {
+					host, _, err := net.SplitHostPort(value)
+					if err != nil {
+						logError.Println("Failed to set endpoint:", value)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+					// Resolve host the same way the UDP branch below does,
+					// rather than net.ParseIP: a bare IP parses fine either
+					// way, but a hostname would otherwise silently leave
+					// tcpEndpoint.ip nil, bucketing every such peer under a
+					// nil IP in the mac2 rate limiter (endpointIP in
+					// transport.go).
+					resolved, err := net.ResolveIPAddr("ip", host)
+					if err != nil {
+						logError.Println("Failed to set endpoint:", value)
+						return &IPCError{Code: ipcErrorInvalid}
+					}
+					// tcpTransport.WritePacket dials this address lazily,
+					// the first time something is sent to the peer.
+					peerCfg.Endpoint = &tcpEndpoint{addr: value, ip: resolved.IP}
+					break
+				}
+
 				addr, err := net.ResolveUDPAddr("udp", value)
 				if err != nil {
 					logError.Println("Failed to set endpoint:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				peer.mutex.Lock()
-				peer.endpoint = addr
-				peer.mutex.Unlock()
+				peerCfg.Endpoint = &udpEndpoint{addr: addr}
 
 			case "persistent_keepalive_interval":
 
@@ -242,31 +244,15 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to set persistent_keepalive_interval:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-
-				old := atomic.SwapUint64(
-					&peer.persistentKeepaliveInterval,
-					secs,
-				)
-
-				// send immediate keep-alive
-
-				if old == 0 && secs != 0 {
-					up, err := device.tun.IsUp()
-					if err != nil {
-						logError.Println("Failed to get tun device status:", err)
-						return &IPCError{Code: ipcErrorIO}
-					}
-					if up {
-						peer.SendKeepAlive()
-					}
-				}
+				s := uint16(secs)
+				peerCfg.PersistentKeepaliveInterval = &s
 
 			case "replace_allowed_ips":
 				if value != "true" {
 					logError.Println("Failed to set replace_allowed_ips, invalid value:", value)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				device.routingTable.RemovePeer(peer)
+				peerCfg.ReplaceAllowedIPs = true
 
 			case "allowed_ip":
 				_, network, err := net.ParseCIDR(value)
@@ -274,8 +260,7 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 					logError.Println("Failed to set allowed_ip:", err)
 					return &IPCError{Code: ipcErrorInvalid}
 				}
-				ones, _ := network.Mask.Size()
-				device.routingTable.Insert(network.IP, uint(ones), peer)
+				peerCfg.AllowedIPs = append(peerCfg.AllowedIPs, *network)
 
 			default:
 				logError.Println("Invalid UAPI key (peer configuration):", key)
@@ -284,7 +269,7 @@ func ipcSetOperation(device *Device, socket *bufio.ReadWriter) *IPCError {
 		}
 	}
 
-	return nil
+	return device.Configure(cfg)
 }
 
 func ipcHandle(device *Device, socket net.Conn) {
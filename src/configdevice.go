@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DeviceConfig is a transport-neutral representation of a UAPI "set"
+// operation. ipcSetOperation (config.go) decodes the line-based text
+// UAPI into a DeviceConfig and applies it via device.Configure, rather
+// than mutating the device directly.
+//
+// This struct was originally meant to be shared with a second,
+// netlink-based UAPI transport so wg(8) could manage the daemon over
+// the same generic-netlink family the in-kernel implementation
+// answers on. That doesn't work: genl families are registered by
+// genl_register_family() in kernel code, not over the wire, so a
+// userspace process can never stand up a competing "wireguard" family
+// for wg(8) to find, and if the kernel module *is* loaded it answers
+// WG_CMD_* directly and this process never sees the request. There is
+// no netlink transport here as a result — only the text UAPI — which
+// matches how upstream wireguard-go actually does this.
+type DeviceConfig struct {
+	PrivateKey *NoisePrivateKey
+	ListenPort *uint16
+	FwMark     *uint32
+
+	// Transport selects the Transport implementation (transport.go)
+	// device.net.conn is (re)opened as: "udp" (the default) or "tcp".
+	// A non-nil value (re)opens the listener even if ListenPort didn't
+	// change, so "transport=tcp" alone is enough to switch.
+	Transport *string
+
+	ReplacePeers bool
+	Peers        []PeerConfig
+}
+
+// PeerConfig is the per-peer portion of a DeviceConfig.
+type PeerConfig struct {
+	PublicKey                   NoisePublicKey
+	PresharedKey                *NoisePresharedKey
+	Remove                      bool
+	Endpoint                    Endpoint
+	PersistentKeepaliveInterval *uint16
+	ReplaceAllowedIPs           bool
+	AllowedIPs                  []net.IPNet
+}
+
+// DeviceState is the transport-neutral counterpart to DeviceConfig,
+// returned by device.Snapshot for a UAPI "get" operation.
+type DeviceState struct {
+	PrivateKey NoisePrivateKey
+	ListenPort uint16
+	Transport  string
+	Peers      []PeerState
+}
+
+// PeerState is the per-peer portion of a DeviceState.
+type PeerState struct {
+	PublicKey                   NoisePublicKey
+	PresharedKey                NoisePresharedKey
+	Endpoint                    Endpoint
+	LastHandshakeTimeSec        int64
+	LastHandshakeTimeNsec       int64
+	TxBytes                     uint64
+	RxBytes                     uint64
+	PersistentKeepaliveInterval uint16
+	AllowedIPs                  []net.IPNet
+
+	// Backpressure metrics surfaced by the fair-queueing scheduler
+	// (scheduler.go), so operators can see which peer is under load.
+	RxDropped    uint64
+	RxQueueDepth int
+	TxQueueDepth int
+}
+
+// Configure applies cfg to device. It implements exactly the semantics
+// that ipcSetOperation used to apply directly: peers are looked up (or
+// created) by public key in the order given, and config.Peers entries
+// are applied in order against the most recently referenced peer.
+func (device *Device) Configure(cfg *DeviceConfig) *IPCError {
+
+	logError := device.log.Error
+	logDebug := device.log.Debug
+
+	if cfg.PrivateKey != nil {
+		device.SetPrivateKey(*cfg.PrivateKey)
+	}
+
+	if cfg.ListenPort != nil {
+		device.net.mutex.Lock()
+		portChanged := device.net.addr.Port != int(*cfg.ListenPort)
+		device.net.addr.Port = int(*cfg.ListenPort)
+		device.net.mutex.Unlock()
+		if portChanged && cfg.Transport == nil {
+			if err := device.setTransport(device.net.transportKind); err != nil {
+				logError.Println("Failed to create listener:", err)
+				return &IPCError{Code: ipcErrorIO}
+			}
+		}
+		// TODO: Clear source address of all peers
+	}
+
+	if cfg.Transport != nil {
+		if err := device.setTransport(*cfg.Transport); err != nil {
+			logError.Println("Failed to set transport:", err)
+			return &IPCError{Code: ipcErrorIO}
+		}
+		// TODO: Clear source address of all peers
+	}
+
+	if cfg.FwMark != nil {
+		logError.Println("FWMark not handled yet")
+		// TODO: Clear source address of all peers
+	}
+
+	if cfg.ReplacePeers {
+		device.RemoveAllPeers()
+	}
+
+	for _, peerConfig := range cfg.Peers {
+
+		device.mutex.RLock()
+		if device.publicKey.Equals(peerConfig.PublicKey) {
+			device.mutex.RUnlock()
+			logError.Println("Public key of peer matches private key of device")
+			return &IPCError{Code: ipcErrorInvalid}
+		}
+		peer, _ := device.peers[peerConfig.PublicKey]
+		device.mutex.RUnlock()
+
+		if peer == nil {
+			if peerConfig.Remove {
+				continue
+			}
+			peer = device.NewPeer(peerConfig.PublicKey)
+		}
+
+		if peerConfig.Remove {
+			device.RemovePeer(peer.handshake.remoteStatic)
+			logDebug.Println("Removing", peer.String())
+			continue
+		}
+
+		if peerConfig.PresharedKey != nil {
+			peer.mutex.Lock()
+			peer.handshake.presharedKey = *peerConfig.PresharedKey
+			peer.mutex.Unlock()
+		}
+
+		if peerConfig.Endpoint != nil {
+			peer.mutex.Lock()
+			peer.endpoint = peerConfig.Endpoint
+			peer.mutex.Unlock()
+		}
+
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			old := atomic.SwapUint64(&peer.persistentKeepaliveInterval, uint64(*peerConfig.PersistentKeepaliveInterval))
+			if old == 0 && *peerConfig.PersistentKeepaliveInterval != 0 {
+				up, err := device.tun.IsUp()
+				if err != nil {
+					logError.Println("Failed to get tun device status:", err)
+					return &IPCError{Code: ipcErrorIO}
+				}
+				if up {
+					peer.SendKeepAlive()
+				}
+			}
+		}
+
+		if peerConfig.ReplaceAllowedIPs {
+			device.routingTable.RemovePeer(peer)
+		}
+
+		for _, network := range peerConfig.AllowedIPs {
+			ones, _ := network.Mask.Size()
+			device.routingTable.Insert(network.IP, uint(ones), peer)
+		}
+	}
+
+	return nil
+}
+
+// Snapshot returns the current device and peer state, transport-neutral,
+// for a UAPI "get" operation.
+func (device *Device) Snapshot() *DeviceState {
+
+	device.mutex.RLock()
+	defer device.mutex.RUnlock()
+
+	state := &DeviceState{
+		PrivateKey: device.privateKey,
+		ListenPort: uint16(device.net.addr.Port),
+		Transport:  device.net.transportKind,
+	}
+
+	for _, peer := range device.peers {
+		func() {
+			peer.mutex.RLock()
+			defer peer.mutex.RUnlock()
+
+			nano := atomic.LoadInt64(&peer.stats.lastHandshakeNano)
+			secs := nano / time.Second.Nanoseconds()
+			nano %= time.Second.Nanoseconds()
+
+			state.Peers = append(state.Peers, PeerState{
+				PublicKey:                   peer.handshake.remoteStatic,
+				PresharedKey:                peer.handshake.presharedKey,
+				Endpoint:                    peer.endpoint,
+				LastHandshakeTimeSec:        secs,
+				LastHandshakeTimeNsec:       nano,
+				TxBytes:                     peer.stats.txBytes,
+				RxBytes:                     peer.stats.rxBytes,
+				PersistentKeepaliveInterval: uint16(atomic.LoadUint64(&peer.persistentKeepaliveInterval)),
+				AllowedIPs:                  device.routingTable.AllowedIPs(peer),
+				RxDropped:                   device.inboundQueueFor(peer).Dropped(),
+				RxQueueDepth:                device.inboundQueueFor(peer).Depth(),
+				TxQueueDepth:                device.tunQueueFor(peer).Depth(),
+			})
+		}()
+	}
+
+	return state
+}
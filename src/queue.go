@@ -0,0 +1,86 @@
+package main
+
+import "sync"
+
+// inboundRing reorders transport packets that were decrypted out of
+// order by the parallel RoutineDecryption worker pool, and hands them
+// back to RoutineSequentialReceiver in the sequence they originally
+// arrived on the wire. There is one ring per peer, stored on
+// peer.queue.ring (see ringFor) for the lifetime of the peer.
+type inboundRing struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	slots   map[uint64]*QueueInboundElement
+	next    uint64
+	counter uint64
+	closed  bool
+}
+
+func newInboundRing(stop chan struct{}) *inboundRing {
+	ring := &inboundRing{
+		slots: make(map[uint64]*QueueInboundElement),
+	}
+	ring.cond = sync.NewCond(&ring.mutex)
+
+	go func() {
+		<-stop
+		ring.mutex.Lock()
+		ring.closed = true
+		ring.cond.Broadcast()
+		ring.mutex.Unlock()
+	}()
+
+	return ring
+}
+
+// Allocate returns the next sequence number to tag an inbound element
+// with. Called once per packet, before it is handed off to the
+// decryption queue, so that arrival order is captured prior to any
+// reordering the worker pool might introduce.
+func (ring *inboundRing) Allocate() uint64 {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	seq := ring.counter
+	ring.counter++
+	return seq
+}
+
+// Deliver is called by a decryption worker once elem has been decrypted
+// (or dropped). It never blocks the calling worker.
+func (ring *inboundRing) Deliver(elem *QueueInboundElement) {
+	ring.mutex.Lock()
+	ring.slots[elem.sequence] = elem
+	ring.cond.Broadcast()
+	ring.mutex.Unlock()
+}
+
+// Next blocks until the element with the next expected sequence number
+// becomes available, then returns it, restoring arrival order. It
+// returns nil once stop (passed to newInboundRing) has closed.
+func (ring *inboundRing) Next(stop chan struct{}) *QueueInboundElement {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	for {
+		if elem, ok := ring.slots[ring.next]; ok {
+			delete(ring.slots, ring.next)
+			ring.next++
+			return elem
+		}
+		if ring.closed {
+			return nil
+		}
+		ring.cond.Wait()
+	}
+}
+
+// ringFor returns peer's inbound reordering ring: a field on Peer
+// itself, set up once in device.NewPeer (peer.go) via:
+//
+//	peer.queue.ring = newInboundRing(peer.signal.stop)
+//
+// rather than looked up from a map keyed by peer identity, so it's
+// freed along with the Peer when device.RemovePeer drops the last
+// reference to it instead of leaking for the life of the process.
+func (device *Device) ringFor(peer *Peer) *inboundRing {
+	return peer.queue.ring
+}
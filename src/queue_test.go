@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInboundRingRestoresOrder(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ring := newInboundRing(stop)
+
+	const n = 8
+	elems := make([]*QueueInboundElement, n)
+	for i := range elems {
+		elems[i] = &QueueInboundElement{sequence: ring.Allocate()}
+	}
+
+	order := []int{3, 1, 0, 2, 7, 4, 6, 5}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, i := range order {
+			ring.Deliver(elems[i])
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		got := ring.Next(stop)
+		if got != elems[i] {
+			t.Fatalf("Next() at position %d = element with sequence %d, want %d", i, got.sequence, elems[i].sequence)
+		}
+	}
+}
+
+func TestInboundRingNextUnblocksOnStop(t *testing.T) {
+	stop := make(chan struct{})
+	ring := newInboundRing(stop)
+
+	done := make(chan *QueueInboundElement, 1)
+	go func() {
+		done <- ring.Next(stop)
+	}()
+
+	close(stop)
+
+	select {
+	case elem := <-done:
+		if elem != nil {
+			t.Fatalf("Next() = %v after stop, want nil", elem)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next() did not unblock after stop was closed")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PeerInboundQueueSize bounds the number of not-yet-decrypted transport
+// packets held per peer. Overflow only drops that peer's own oldest
+// packet, instead of the previous single shared device.queue.decryption
+// channel where one noisy peer could push out another peer's traffic.
+const PeerInboundQueueSize = 1024
+
+// DeficitQuantum is the number of packets a peer may hand to the
+// decryption pool per scheduling round (deficit round robin), once it
+// has packets waiting.
+const DeficitQuantum = 8
+
+// peerInboundQueue is a bounded, per-peer FIFO of not-yet-decrypted
+// QueueInboundElements, drained by RoutineInboundScheduler. It replaces
+// pushing directly into the shared device.queue.decryption channel, so
+// that a flood from one peer can only ever drop that peer's own
+// packets.
+type peerInboundQueue struct {
+	mutex   sync.Mutex
+	elems   []*QueueInboundElement
+	dropped uint64
+
+	// ring is this peer's reordering ring (queue.go). A dropped element
+	// (either here, on overflow, or in RoutineInboundScheduler, on
+	// shutdown) is still delivered to it, marked dropped, so
+	// RoutineSequentialReceiver's sequence counter never stalls waiting
+	// on a packet that will never arrive.
+	ring *inboundRing
+
+	// ready is device.queue.inboundReady: Push signals it so
+	// RoutineInboundScheduler wakes promptly instead of polling.
+	ready chan struct{}
+}
+
+func newPeerInboundQueue(ring *inboundRing, ready chan struct{}) *peerInboundQueue {
+	return &peerInboundQueue{ring: ring, ready: ready}
+}
+
+// Push enqueues elem, dropping this queue's own oldest element (still
+// handed to the ring, see peerInboundQueue.ring) if full, then wakes
+// RoutineInboundScheduler.
+func (q *peerInboundQueue) Push(elem *QueueInboundElement) {
+	q.mutex.Lock()
+	if len(q.elems) >= PeerInboundQueueSize {
+		oldest := q.elems[0]
+		q.elems = q.elems[1:]
+		atomic.AddUint64(&q.dropped, 1)
+		oldest.Drop()
+		q.ring.Deliver(oldest)
+	}
+	q.elems = append(q.elems, elem)
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop removes and returns the oldest element, or nil if empty.
+func (q *peerInboundQueue) Pop() *QueueInboundElement {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.elems) == 0 {
+		return nil
+	}
+	elem := q.elems[0]
+	q.elems = q.elems[1:]
+	return elem
+}
+
+// Depth reports the number of packets currently queued.
+func (q *peerInboundQueue) Depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.elems)
+}
+
+// Dropped reports the total number of packets dropped for being over
+// PeerInboundQueueSize, for the UAPI rx_dropped counter.
+func (q *peerInboundQueue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// inboundQueueFor returns peer's bounded inbound queue: a field on
+// Peer itself, set up once in device.NewPeer (peer.go) via:
+//
+//	peer.queue.pending = newPeerInboundQueue(peer.queue.ring, device.queue.inboundReady)
+//
+// rather than looked up from a map keyed by peer identity, so it's
+// freed along with the Peer when device.RemovePeer drops the last
+// reference to it instead of leaking for the life of the process.
+func (device *Device) inboundQueueFor(peer *Peer) *peerInboundQueue {
+	return peer.queue.pending
+}
+
+// PeerTUNQueueSize bounds the number of already-decrypted packets held
+// per peer while they wait for a turn on device.queue.inbound (drained
+// by RoutineWriteToTUN). This is the TUN-writer-side counterpart to
+// PeerInboundQueueSize: overflow only drops that peer's own oldest
+// packet, so a flooding peer can't evict another peer's packet that's
+// already been decrypted and is sitting right in front of the TUN
+// device.
+const PeerTUNQueueSize = 1024
+
+// peerTUNQueue is a bounded, per-peer FIFO of decrypted packets awaiting
+// a turn on device.queue.inbound, drained by RoutineTUNScheduler. Unlike
+// peerInboundQueue it doesn't need a reordering ring behind it: packets
+// reach it already in order, since RoutineSequentialReceiver (one
+// goroutine per peer) pushes them one at a time.
+type peerTUNQueue struct {
+	mutex sync.Mutex
+	elems []*QueueInboundElement
+
+	// device is needed only to release a dropped element's message
+	// buffer (device.PutMessageBuffer); unlike peerInboundQueue's drops,
+	// nothing downstream is waiting on a sequence number for this one.
+	device *Device
+
+	// ready is device.queue.tunReady: Push signals it so
+	// RoutineTUNScheduler wakes promptly instead of polling.
+	ready chan struct{}
+}
+
+func newPeerTUNQueue(device *Device, ready chan struct{}) *peerTUNQueue {
+	return &peerTUNQueue{device: device, ready: ready}
+}
+
+// Push enqueues elem, dropping this queue's own oldest element (and
+// releasing its buffer) if full, then wakes RoutineTUNScheduler.
+func (q *peerTUNQueue) Push(elem *QueueInboundElement) {
+	q.mutex.Lock()
+	if len(q.elems) >= PeerTUNQueueSize {
+		oldest := q.elems[0]
+		q.elems = q.elems[1:]
+		q.device.PutMessageBuffer(oldest.buffer)
+	}
+	q.elems = append(q.elems, elem)
+	q.mutex.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop removes and returns the oldest element, or nil if empty.
+func (q *peerTUNQueue) Pop() *QueueInboundElement {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.elems) == 0 {
+		return nil
+	}
+	elem := q.elems[0]
+	q.elems = q.elems[1:]
+	return elem
+}
+
+// Depth reports the number of packets currently queued, for the UAPI
+// tx_queue_depth counter.
+func (q *peerTUNQueue) Depth() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.elems)
+}
+
+// tunQueueFor returns peer's bounded TUN-writer queue: a field on Peer
+// itself, set up once in device.NewPeer (peer.go) via:
+//
+//	peer.queue.tunPending = newPeerTUNQueue(device, device.queue.tunReady)
+//
+// for the same reason inboundQueueFor returns a Peer field rather than a
+// map lookup: it's freed along with the Peer instead of leaking.
+func (device *Device) tunQueueFor(peer *Peer) *peerTUNQueue {
+	return peer.queue.tunPending
+}
+
+// RoutineTUNScheduler is RoutineInboundScheduler's counterpart for the
+// decrypted-packet to TUN-writer hop: it fans every peer's peerTUNQueue
+// into the shared device.queue.inbound channel (drained by
+// RoutineWriteToTUN) using the same deficit round robin, instead of
+// RoutineSequentialReceiver pushing straight into device.queue.inbound
+// and letting one peer's flood evict another peer's already-decrypted
+// packet right before it reaches the TUN device.
+//
+// It wakes on device.queue.tunReady the same way RoutineInboundScheduler
+// wakes on device.queue.inboundReady, rather than polling.
+func (device *Device) RoutineTUNScheduler() {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine, TUN-writer fair scheduler, started")
+
+	deficits := make(map[*Peer]int)
+
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-device.queue.tunReady:
+		}
+
+		device.mutex.RLock()
+		peers := make([]*Peer, 0, len(device.peers))
+		for _, peer := range device.peers {
+			peers = append(peers, peer)
+		}
+		device.mutex.RUnlock()
+
+		backlogged := false
+		for _, peer := range peers {
+			queue := device.tunQueueFor(peer)
+			if queue.Depth() == 0 {
+				continue
+			}
+			deficits[peer] += DeficitQuantum
+
+			for deficits[peer] > 0 {
+				elem := queue.Pop()
+				if elem == nil {
+					deficits[peer] = 0
+					break
+				}
+				select {
+				case device.queue.inbound <- elem:
+				case <-device.signal.stop:
+					device.PutMessageBuffer(elem.buffer)
+					return
+				}
+				deficits[peer]--
+			}
+			if queue.Depth() > 0 {
+				backlogged = true
+			}
+		}
+
+		// a peer that used up its quantum still has packets queued: run
+		// another round instead of waiting for the next Push
+		if backlogged {
+			select {
+			case device.queue.tunReady <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// RoutineInboundScheduler fans queued, not-yet-decrypted packets from
+// every peer's bounded queue (see peerInboundQueue) into the shared
+// device.queue.decryption channel using deficit round robin, so peers
+// get a fair share of the decryption worker pool under load instead of
+// whichever peer's packets happen to arrive first.
+//
+// It wakes on device.queue.inboundReady (a 1-buffered channel every
+// peerInboundQueue.Push signals) rather than polling every peer on a
+// fixed interval, so there's no per-peer lock traffic at all while the
+// device is idle.
+//
+// The handoff to device.queue.decryption itself blocks (selecting only
+// against device.signal.stop) instead of evicting whatever happens to
+// be sitting at the head of that channel: the old addToInboundQueue
+// behavior could silently drop an unrelated, already-scheduled peer's
+// packet at this second chokepoint, which defeated the whole point of
+// scheduling fairly in the first place. Blocking here simply applies
+// backpressure to this peer's own quantum; if the decryption pool stays
+// saturated long enough that this peer's own queue fills up too, Push
+// drops that peer's own oldest packet and counts it against that
+// peer's own rx_dropped, same as ever.
+func (device *Device) RoutineInboundScheduler() {
+	logDebug := device.log.Debug
+	logDebug.Println("Routine, inbound fair scheduler, started")
+
+	deficits := make(map[*Peer]int)
+
+	for {
+		select {
+		case <-device.signal.stop:
+			return
+		case <-device.queue.inboundReady:
+		}
+
+		device.mutex.RLock()
+		peers := make([]*Peer, 0, len(device.peers))
+		for _, peer := range device.peers {
+			peers = append(peers, peer)
+		}
+		device.mutex.RUnlock()
+
+		backlogged := false
+		for _, peer := range peers {
+			queue := device.inboundQueueFor(peer)
+			if queue.Depth() == 0 {
+				continue
+			}
+			deficits[peer] += DeficitQuantum
+
+			for deficits[peer] > 0 {
+				elem := queue.Pop()
+				if elem == nil {
+					deficits[peer] = 0
+					break
+				}
+				select {
+				case device.queue.decryption <- elem:
+				case <-device.signal.stop:
+					elem.Drop()
+					atomic.AddUint64(&queue.dropped, 1)
+					queue.ring.Deliver(elem)
+					return
+				}
+				deficits[peer]--
+			}
+			if queue.Depth() > 0 {
+				backlogged = true
+			}
+		}
+
+		// a peer that used up its quantum still has packets queued: run
+		// another round instead of waiting for the next Push
+		if backlogged {
+			select {
+			case device.queue.inboundReady <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestPeerInboundQueuePushPopOrder(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	ring := newInboundRing(stop)
+	queue := newPeerInboundQueue(ring, make(chan struct{}, 1))
+
+	a := &QueueInboundElement{sequence: 0}
+	b := &QueueInboundElement{sequence: 1}
+	queue.Push(a)
+	queue.Push(b)
+
+	if got := queue.Pop(); got != a {
+		t.Fatalf("Pop() = %v, want first-pushed element", got)
+	}
+	if got := queue.Pop(); got != b {
+		t.Fatalf("Pop() = %v, want second-pushed element", got)
+	}
+	if got := queue.Pop(); got != nil {
+		t.Fatalf("Pop() on empty queue = %v, want nil", got)
+	}
+}
+
+func TestPeerInboundQueueOverflowDropsOwnOldestAndDeliversToRing(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	ring := newInboundRing(stop)
+	queue := newPeerInboundQueue(ring, make(chan struct{}, 1))
+
+	for i := 0; i < PeerInboundQueueSize+1; i++ {
+		queue.Push(&QueueInboundElement{sequence: uint64(i)})
+	}
+
+	if got := queue.Dropped(); got != 1 {
+		t.Fatalf("Dropped() = %d, want 1", got)
+	}
+	if got := queue.Depth(); got != PeerInboundQueueSize {
+		t.Fatalf("Depth() = %d, want %d", got, PeerInboundQueueSize)
+	}
+
+	// The evicted element (sequence 0) must still reach the ring, marked
+	// dropped, or RoutineSequentialReceiver would stall forever waiting
+	// on a sequence number nothing will ever fill.
+	oldest := ring.Next(stop)
+	if oldest == nil || oldest.sequence != 0 {
+		t.Fatalf("ring did not receive the dropped element; got %v", oldest)
+	}
+	if !oldest.IsDropped() {
+		t.Fatal("element evicted by overflow was not marked dropped")
+	}
+}
+
+func TestPeerInboundQueuePushWakesScheduler(t *testing.T) {
+	ring := newInboundRing(make(chan struct{}))
+	ready := make(chan struct{}, 1)
+	queue := newPeerInboundQueue(ring, ready)
+
+	queue.Push(&QueueInboundElement{})
+
+	select {
+	case <-ready:
+	default:
+		t.Fatal("Push did not signal the scheduler's ready channel")
+	}
+}
+
+func TestPeerTUNQueuePushPopOrder(t *testing.T) {
+	queue := newPeerTUNQueue(nil, make(chan struct{}, 1))
+
+	a := &QueueInboundElement{sequence: 0}
+	b := &QueueInboundElement{sequence: 1}
+	queue.Push(a)
+	queue.Push(b)
+
+	if got := queue.Pop(); got != a {
+		t.Fatalf("Pop() = %v, want first-pushed element", got)
+	}
+	if got := queue.Pop(); got != b {
+		t.Fatalf("Pop() = %v, want second-pushed element", got)
+	}
+	if got := queue.Pop(); got != nil {
+		t.Fatalf("Pop() on empty queue = %v, want nil", got)
+	}
+}
+
+func TestPeerTUNQueuePushWakesScheduler(t *testing.T) {
+	ready := make(chan struct{}, 1)
+	queue := newPeerTUNQueue(nil, ready)
+
+	queue.Push(&QueueInboundElement{})
+
+	select {
+	case <-ready:
+	default:
+		t.Fatal("Push did not signal the scheduler's ready channel")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Endpoint abstracts the remote identity of a peer across whatever
+// Transport is in use: a *udpEndpoint (wrapping a *net.UDPAddr) for the
+// default UDP transport, or
+// a per-connection handle for the framed TCP transport.
+type Endpoint interface {
+	String() string
+}
+
+// Transport abstracts the socket underlying the ingress/egress and
+// cookie-reply paths (RoutineReceiveIncomming, RoutineHandshake,
+// peer.SendBuffer, ...) away from *net.UDPConn, so WireGuard traffic can
+// be carried over anything that can move length-delimited datagrams:
+// UDP (the default, transport_udp.go), TCP (transport_tcp.go), or a TLS/
+// QUIC/WebSocket implementation built the same way.
+type Transport interface {
+	ReadPacket(buf []byte) (n int, endpoint Endpoint, err error)
+	WritePacket(buf []byte, endpoint Endpoint) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// BatchTransport is implemented by transports that can service several
+// datagrams per read (recvmmsg-backed UDP). RoutineReceiveIncomming
+// type-asserts for it and falls back to repeated ReadPacket calls on
+// transports, like the TCP one, that don't support it.
+type BatchTransport interface {
+	Transport
+	ReadBatch(buffers [][]byte) (sizes []int, endpoints []Endpoint, err error)
+}
+
+var errTransportEndpointType = errors.New("transport: endpoint belongs to a different transport")
+
+// endpointIP extracts the remote IP of endpoint, for the mac1/mac2
+// rate-limiting and cookie machinery (RoutineHandshake), which only
+// ever needs the address, not the transport-specific connection handle.
+func endpointIP(endpoint Endpoint) net.IP {
+	switch e := endpoint.(type) {
+	case *udpEndpoint:
+		return e.addr.IP
+	case *tcpEndpoint:
+		return e.ip
+	default:
+		return nil
+	}
+}
+
+// NewTransport opens the configured transport kind ("udp", the
+// default, or "tcp") bound to addr.
+func NewTransport(kind string, addr *net.UDPAddr) (Transport, error) {
+	switch kind {
+	case "", "udp":
+		return NewUDPTransport(addr)
+	case "tcp":
+		return NewTCPTransport(&net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone})
+	default:
+		return nil, errors.New("transport: unknown kind " + kind)
+	}
+}
+
+// setTransport (re)opens device.net.conn as the requested transport
+// kind, bound to the currently configured listen port, closing
+// whatever was open before. Used by device.Configure to apply both
+// "listen_port" and the new "transport" UAPI key.
+func (device *Device) setTransport(kind string) error {
+	netc := &device.net
+	netc.mutex.Lock()
+	defer netc.mutex.Unlock()
+
+	if netc.conn != nil {
+		netc.conn.Close()
+	}
+
+	conn, err := NewTransport(kind, netc.addr)
+	if err != nil {
+		return err
+	}
+
+	netc.conn = conn
+	if kind == "" {
+		kind = "udp"
+	}
+	netc.transportKind = kind
+	return nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxTCPFrameSize bounds a single length-prefixed frame at
+// MaxMessageSize, matching the largest WireGuard message, so a
+// misbehaving peer can't make us allocate unboundedly.
+const MaxTCPFrameSize = MaxMessageSize
+
+// TCPInboundQueueSize bounds how many fully-framed messages may be
+// buffered across all connections awaiting a ReadPacket call.
+const TCPInboundQueueSize = 1024
+
+// tcpEndpoint identifies a peer connected over the framed TCP
+// transport: one net.Conn per endpoint, either accepted (a peer dialed
+// us) or opened by tcpTransport.dial (we dialed a peer configured via
+// the UAPI "endpoint" key, e.g. from behind a middlebox that blocks
+// UDP). ip is best-effort, for endpointIP's rate-limiter lookup; it may
+// be nil until the connection is established.
+type tcpEndpoint struct {
+	addr string
+	ip   net.IP
+}
+
+func (e *tcpEndpoint) String() string {
+	return e.addr
+}
+
+// tcpTransport carries WireGuard messages length-prefixed over plain
+// TCP connections, for deployments behind middleboxes that block UDP.
+// Each connection, whether accepted or dialed, becomes one Endpoint;
+// frames read off any of them are demultiplexed into a single shared
+// inbound queue for ReadPacket, and WritePacket looks the right
+// connection back up by endpoint, dialing one out on first use if
+// none exists yet.
+type tcpTransport struct {
+	listener net.Listener
+
+	mutex sync.RWMutex
+	conns map[string]*tcpConn
+
+	inbound chan tcpFrame
+	closed  chan struct{}
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+// tcpConn pairs an accepted or dialed connection with the mutex that
+// serializes WritePacket's length-prefix-then-payload write against it.
+// Without this, a cookie reply from RoutineHandshake racing a data
+// packet from the peer's own sender could interleave their frames on
+// the wire and permanently desync the framing for everything sent
+// after.
+type tcpConn struct {
+	net.Conn
+	writeMutex sync.Mutex
+}
+
+type tcpFrame struct {
+	packet   []byte
+	endpoint *tcpEndpoint
+	err      error
+}
+
+// tcpTimeoutError is returned by ReadPacket once the deadline set via
+// SetReadDeadline elapses, mirroring the net.OpError{timeout: true}
+// *net.UDPConn.ReadFromUDP returns in the same situation. It's how
+// RoutineReceiveIncomming periodically re-checks device.signal.stop
+// even while no peer has sent anything.
+type tcpTimeoutError struct{}
+
+func (tcpTimeoutError) Error() string   { return "tcp transport: read timeout" }
+func (tcpTimeoutError) Timeout() bool   { return true }
+func (tcpTimeoutError) Temporary() bool { return true }
+
+var errTCPReadTimeout error = tcpTimeoutError{}
+
+// NewTCPTransport listens on addr and starts accepting and
+// demultiplexing framed connections. The same transport also dials out
+// (see dial, WritePacket) to peers whose endpoint was configured but
+// never connected to us.
+func NewTCPTransport(addr *net.TCPAddr) (*tcpTransport, error) {
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &tcpTransport{
+		listener: listener,
+		conns:    make(map[string]*tcpConn),
+		inbound:  make(chan tcpFrame, TCPInboundQueueSize),
+		closed:   make(chan struct{}),
+	}
+
+	go transport.acceptLoop()
+
+	return transport, nil
+}
+
+// acceptLoop accepts inbound connections until the listener is closed.
+// Only a closed-listener error is terminal; anything else (e.g. EMFILE
+// under connection churn, exactly the adversarial condition a public
+// TCP fallback listener will see) is transient, so the loop drops it
+// without logging and keeps accepting instead of shutting the transport
+// down permanently.
+func (t *tcpTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				select {
+				case t.inbound <- tcpFrame{err: err}:
+				case <-t.closed:
+				}
+				return
+			}
+			continue
+		}
+
+		endpoint := &tcpEndpoint{addr: conn.RemoteAddr().String()}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			endpoint.ip = tcpAddr.IP
+		}
+
+		tc := &tcpConn{Conn: conn}
+
+		t.mutex.Lock()
+		t.conns[endpoint.addr] = tc
+		t.mutex.Unlock()
+
+		go t.readLoop(tc, endpoint)
+	}
+}
+
+// dial opens an outbound connection to endpoint.addr. Used by
+// WritePacket the first time it's asked to send to an endpoint that
+// was configured (UAPI "endpoint" key) but never accepted an inbound
+// connection from — the client side of a middlebox-avoiding
+// deployment, which has no listener to receive a connection on.
+func (t *tcpTransport) dial(endpoint *tcpEndpoint) (*tcpConn, error) {
+	conn, err := net.Dial("tcp", endpoint.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		endpoint.ip = tcpAddr.IP
+	}
+
+	tc := &tcpConn{Conn: conn}
+
+	t.mutex.Lock()
+	if existing, ok := t.conns[endpoint.addr]; ok {
+		// Lost a race with an inbound accept or another dial for the
+		// same endpoint; keep whichever connection got there first.
+		t.mutex.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	t.conns[endpoint.addr] = tc
+	t.mutex.Unlock()
+
+	go t.readLoop(tc, endpoint)
+	return tc, nil
+}
+
+func (t *tcpTransport) readLoop(conn *tcpConn, endpoint *tcpEndpoint) {
+	defer func() {
+		t.mutex.Lock()
+		delete(t.conns, endpoint.addr)
+		t.mutex.Unlock()
+		conn.Close()
+	}()
+
+	var length [4]byte
+
+	for {
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		size := binary.BigEndian.Uint32(length[:])
+		if size == 0 || size > MaxTCPFrameSize {
+			return
+		}
+
+		packet := make([]byte, size)
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+
+		select {
+		case t.inbound <- tcpFrame{packet: packet, endpoint: endpoint}:
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *tcpTransport) ReadPacket(buf []byte) (int, Endpoint, error) {
+	t.deadlineMutex.Lock()
+	deadline := t.readDeadline
+	t.deadlineMutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case frame := <-t.inbound:
+		if frame.err != nil {
+			return 0, nil, frame.err
+		}
+		return copy(buf, frame.packet), frame.endpoint, nil
+	case <-t.closed:
+		return 0, nil, errors.New("tcp transport: closed")
+	case <-timeout:
+		return 0, nil, errTCPReadTimeout
+	}
+}
+
+func (t *tcpTransport) WritePacket(buf []byte, endpoint Endpoint) error {
+	tcpEp, ok := endpoint.(*tcpEndpoint)
+	if !ok {
+		return errTransportEndpointType
+	}
+
+	t.mutex.RLock()
+	conn, ok := t.conns[tcpEp.addr]
+	t.mutex.RUnlock()
+
+	if !ok {
+		var err error
+		conn, err = t.dial(tcpEp)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Built into one frame and issued as a single Write, under this
+	// connection's writeMutex, so that a concurrent WritePacket to the
+	// same endpoint (a cookie reply from RoutineHandshake racing a data
+	// packet from the peer's own sender) can never interleave its
+	// length prefix and payload with this one.
+	frame := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(buf)))
+	copy(frame[4:], buf)
+
+	conn.writeMutex.Lock()
+	_, err := conn.Write(frame)
+	conn.writeMutex.Unlock()
+	return err
+}
+
+// SetReadDeadline arms the timer ReadPacket races against, so
+// RoutineReceiveIncomming's once-a-second deadline still unblocks
+// ReadPacket (and lets it re-check device.signal.stop) even when no
+// peer has sent anything, the same way it does for the UDP transport.
+func (t *tcpTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadlineMutex.Lock()
+	t.readDeadline = deadline
+	t.deadlineMutex.Unlock()
+	return nil
+}
+
+func (t *tcpTransport) Close() error {
+	close(t.closed)
+
+	t.mutex.Lock()
+	for _, conn := range t.conns {
+		conn.Close()
+	}
+	t.mutex.Unlock()
+
+	return t.listener.Close()
+}
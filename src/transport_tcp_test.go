@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPTransportReadPacketFramesMessage(t *testing.T) {
+	transport, err := NewTCPTransport(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	defer transport.Close()
+
+	conn, err := net.Dial("tcp", transport.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	payload := []byte("hello wireguard")
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(payload)))
+	if _, err := conn.Write(length[:]); err != nil {
+		t.Fatalf("write length: %v", err)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+
+	buf := make([]byte, MaxTCPFrameSize)
+	n, endpoint, err := transport.ReadPacket(buf)
+	if err != nil {
+		t.Fatalf("ReadPacket: %v", err)
+	}
+	if string(buf[:n]) != string(payload) {
+		t.Fatalf("ReadPacket payload = %q, want %q", buf[:n], payload)
+	}
+	if endpoint == nil {
+		t.Fatal("ReadPacket returned a nil endpoint")
+	}
+}
+
+func TestTCPTransportWritePacketDialsOut(t *testing.T) {
+	server, err := NewTCPTransport(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("NewTCPTransport(server): %v", err)
+	}
+	defer server.Close()
+
+	client, err := NewTCPTransport(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("NewTCPTransport(client): %v", err)
+	}
+	defer client.Close()
+
+	// endpoint was never accepted from; WritePacket must dial out to it.
+	endpoint := &tcpEndpoint{addr: server.listener.Addr().String()}
+	payload := []byte("dial me")
+	if err := client.WritePacket(payload, endpoint); err != nil {
+		t.Fatalf("WritePacket (dial-out): %v", err)
+	}
+
+	buf := make([]byte, MaxTCPFrameSize)
+	n, _, err := server.ReadPacket(buf)
+	if err != nil {
+		t.Fatalf("ReadPacket on server: %v", err)
+	}
+	if string(buf[:n]) != string(payload) {
+		t.Fatalf("got %q, want %q", buf[:n], payload)
+	}
+}
+
+func TestTCPTransportReadPacketTimesOut(t *testing.T) {
+	transport, err := NewTCPTransport(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		t.Fatalf("NewTCPTransport: %v", err)
+	}
+	defer transport.Close()
+
+	transport.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+	buf := make([]byte, MaxTCPFrameSize)
+	_, _, err = transport.ReadPacket(buf)
+	if err == nil {
+		t.Fatal("ReadPacket returned no error past its deadline")
+	}
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("ReadPacket error = %v, want a net.Error with Timeout() == true", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"time"
+)
+
+// udpEndpoint is the Endpoint implementation used by udpTransport, the
+// default Transport.
+type udpEndpoint struct {
+	addr *net.UDPAddr
+}
+
+func (e *udpEndpoint) String() string {
+	return e.addr.String()
+}
+
+// udpTransport is the default Transport: plain UDP, read via
+// ReadBatch (recvmmsg on Linux) where the kernel supports it. Exactly
+// one of batch4/batch6 is set, matching the address family the socket
+// actually ended up bound to, since the ipv4 and ipv6 PacketConn
+// wrappers aren't interchangeable.
+type udpTransport struct {
+	conn   *net.UDPConn
+	batch4 *ipv4.PacketConn
+	batch6 *ipv6.PacketConn
+}
+
+// NewUDPTransport opens a UDP socket bound to addr.
+func NewUDPTransport(addr *net.UDPAddr) (*udpTransport, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &udpTransport{conn: conn}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() != nil {
+		t.batch4 = ipv4.NewPacketConn(conn)
+	} else {
+		t.batch6 = ipv6.NewPacketConn(conn)
+	}
+	return t, nil
+}
+
+func (t *udpTransport) ReadPacket(buf []byte) (int, Endpoint, error) {
+	n, raddr, err := t.conn.ReadFromUDP(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, &udpEndpoint{addr: raddr}, nil
+}
+
+// ReadBatch services ReceiveBatchSize-sized reads for
+// RoutineReceiveIncomming via a single recvmmsg(2) on Linux.
+func (t *udpTransport) ReadBatch(buffers [][]byte) ([]int, []Endpoint, error) {
+	if t.batch4 != nil {
+		return readBatchV4(t.batch4, buffers)
+	}
+	return readBatchV6(t.batch6, buffers)
+}
+
+func readBatchV4(batch *ipv4.PacketConn, buffers [][]byte) ([]int, []Endpoint, error) {
+	msgs := make([]ipv4.Message, len(buffers))
+	for i := range buffers {
+		msgs[i].Buffers = [][]byte{buffers[i]}
+	}
+
+	count, err := batch.ReadBatch(msgs, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sizes := make([]int, count)
+	endpoints := make([]Endpoint, count)
+	for i := 0; i < count; i++ {
+		sizes[i] = msgs[i].N
+		if raddr, ok := msgs[i].Addr.(*net.UDPAddr); ok {
+			endpoints[i] = &udpEndpoint{addr: raddr}
+		}
+	}
+	return sizes, endpoints, nil
+}
+
+func readBatchV6(batch *ipv6.PacketConn, buffers [][]byte) ([]int, []Endpoint, error) {
+	msgs := make([]ipv6.Message, len(buffers))
+	for i := range buffers {
+		msgs[i].Buffers = [][]byte{buffers[i]}
+	}
+
+	count, err := batch.ReadBatch(msgs, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sizes := make([]int, count)
+	endpoints := make([]Endpoint, count)
+	for i := 0; i < count; i++ {
+		sizes[i] = msgs[i].N
+		if raddr, ok := msgs[i].Addr.(*net.UDPAddr); ok {
+			endpoints[i] = &udpEndpoint{addr: raddr}
+		}
+	}
+	return sizes, endpoints, nil
+}
+
+func (t *udpTransport) WritePacket(buf []byte, endpoint Endpoint) error {
+	udpEp, ok := endpoint.(*udpEndpoint)
+	if !ok {
+		return errTransportEndpointType
+	}
+	_, err := t.conn.WriteToUDP(buf, udpEp.addr)
+	return err
+}
+
+func (t *udpTransport) SetReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}